@@ -1,16 +1,20 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Constants
@@ -21,21 +25,63 @@ const (
 
 // Variables
 var (
-	port               int                     // Port number to listen on
-	accessCountLimit   int64                   // Total access count limit
-	accessCounter      int64                   // Counter to track the total access count
-	mu                 sync.Mutex              // Mutex to synchronize accessCounter updates
-	realKey            string                  // Real OpenAI API key
-	virtualKeyFilePath string                  // Path to the file containing virtual OpenAI API keys
-	virtualKeys        = make(map[string]bool) // Map to store virtual OpenAI API keys
+	port               int                              // Port number to listen on
+	accessCountLimit   int64                            // Total access count limit
+	accessCounter      int64                            // Counter to track the total access count
+	mu                 sync.Mutex                       // Mutex to synchronize accessCounter updates
+	fallbackRealKey    string                           // Real OpenAI API key used when a virtual key has no explicit pool
+	virtualKeyFilePath string                           // Path to the file containing virtual OpenAI API keys
+	virtualKeys        = make(map[string]*keyPool)      // Map to store virtual OpenAI API keys and their real-key pools
+	virtualKeyUsage    = make(map[string]*usageCounter) // Map to store per-virtual-key quota and rate-limit state
+	virtualKeyUsageMu  sync.RWMutex                     // Guards virtualKeyUsage against concurrent route-reload inserts
+	usageFilePath      string                           // Path to the file used to persist usage counters across restarts
+	usageFlushInterval time.Duration                    // How often dirty usage counters are flushed to -usage-file
+	adminToken         string                           // Bearer token required to access /admin/usage; empty disables the endpoint
+	upstreamTransport  *http.Transport                  // Transport used for all upstream requests; built from the flags in transport.go
+	shutdownTimeout    time.Duration                    // How long to wait for in-flight requests to finish on shutdown
 )
 
+// keyPool holds the real OpenAI API keys associated with a single virtual key
+// and round-robins across them so load can be spread over several upstream
+// accounts.
+type keyPool struct {
+	mu      sync.Mutex
+	keys    []string
+	counter uint64
+}
+
+// next returns the next real key in the pool, along with its index, rotating
+// in round-robin order. The counter wraps well before it could overflow.
+func (p *keyPool) next() (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idx := int(p.counter % uint64(len(p.keys)))
+	p.counter++
+	if p.counter >= 1<<62 {
+		p.counter = 0
+	}
+	return p.keys[idx], idx
+}
+
 // init function to initialize command-line flags
 func init() {
 	// Define command-line flags
 	flag.IntVar(&port, "port", 48080, "Port number to listen on.")
-	flag.Int64Var(&accessCountLimit, "access-count-limit", -1, "Total access count limit. Use -1 for no limit.")
+	flag.Int64Var(&accessCountLimit, "access-count-limit", -1, "Total access count limit, summed across every virtual key. This is an independent\nblanket fuse enforced before per-virtual-key quotas (see -virtual-keys-file); it does\nnot replace them. Use -1 for no limit.")
 	flag.StringVar(&virtualKeyFilePath, "virtual-keys-file", "virtual-api-keys.txt", "Path to the file containing virtual OpenAI API keys.\nEach key should be specified on a separate line.")
+	flag.StringVar(&usageFilePath, "usage-file", "virtual-key-usage.json", "Path to the file used to persist per-virtual-key usage counters across restarts.")
+	flag.DurationVar(&usageFlushInterval, "usage-flush-interval", 5*time.Second, "How often usage counters are flushed to -usage-file, when a request has changed them\nsince the last flush. Also flushed once on graceful shutdown.")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required to access /admin/usage. If empty, the endpoint is disabled.")
+	flag.StringVar(&configFilePath, "config", "", "Path to a JSON routing config file mapping path prefixes to upstream hosts.\nIf empty, all requests go to "+HOST_OPENAI_API+". Reloaded on SIGHUP.")
+	flag.StringVar(&rewriteConfigFilePath, "rewrite-config", "", "Path to a JSON file of request/response rewrite rules, keyed per virtual key or path prefix.\nReloaded on SIGHUP.")
+	flag.StringVar(&upstreamProxyURL, "upstream-proxy", "", "URL of an HTTP(S) proxy to egress through when dialing upstream.\nIf empty, falls back to the HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables.")
+	flag.StringVar(&caBundlePath, "ca-bundle", "", "Path to a PEM bundle of extra CA certificates to trust when dialing upstream,\nin addition to the system trust store. Needed for self-hosted OpenAI-compatible endpoints\nbehind a private CA.")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second, "Timeout for establishing the upstream TCP connection.")
+	flag.DurationVar(&tlsHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Timeout for the upstream TLS handshake.")
+	flag.DurationVar(&responseHeaderTimeout, "response-header-timeout", 60*time.Second, "Timeout waiting for the upstream response headers.")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", 90*time.Second, "How long an idle upstream connection is kept in the pool before being closed.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests to finish after receiving SIGINT/SIGTERM.")
 
 	additionalHelp1 := `
 This program offers reverse proxy functionality to the OpenAI API server with additional features, including:
@@ -44,10 +90,57 @@ This program offers reverse proxy functionality to the OpenAI API server with ad
 `
 	additionalHelp2 := fmt.Sprintf(`
 Note:
+  * -access-count-limit is a global request count across all virtual keys
+    combined, checked before anything else; it's a blanket fuse, separate
+    from (and in addition to) the per-virtual-key quotas below.
   * Set your real OpenAI API key as the environment variable: %s.
   * Configure your app's OpenAI API access to use http://<ip-or-hostname-of-this-machine>:<port>/v1.
     Ensure the path includes "/v1".
-`, EVN_OPENAI_API_KEY)
+  * Each line in the virtual keys file may map to one or more real keys, separated
+    by "|", to spread load across several upstream accounts:
+      virt_xxx = sk-aaa|sk-bbb|sk-ccc
+    A line with no "=" is still accepted and falls back to the %s environment
+    variable, preserving the previous behavior.
+  * Optional quota attributes may follow the real-key pool after a ";",
+    space-separated, to cap how much a virtual key can be used:
+      virt_xxx = sk-aaa|sk-bbb ; requests_per_minute=60 daily_limit=1000 monthly_limit=20000 total_limit=100000
+    Requests beyond requests_per_minute get 429 with a Retry-After header;
+    requests beyond any other limit get 422. Counters are persisted to
+    -usage-file (debounced; see -usage-flush-interval) so they survive a
+    restart, and can be inspected at /admin/usage using
+    "Authorization: Bearer <-admin-token>".
+  * By default every request goes to %s, with its path untouched. Pass
+    -config to route different path prefixes to different upstreams
+    (OpenAI, Azure OpenAI, Anthropic, self-hosted, ...), each with its own
+    auth header style and, optionally, its own real-key pools so the same
+    virtual key can hold distinct real keys per provider:
+      {"routes": [
+        {"path_prefix": "/v1", "scheme": "https", "host": "api.openai.com",
+         "auth_header": "Authorization", "auth_prefix": "Bearer "},
+        {"path_prefix": "/anthropic", "scheme": "https", "host": "api.anthropic.com",
+         "path_rewrite": "", "auth_header": "x-api-key",
+         "extra_headers": {"anthropic-version": "2023-06-01"},
+         "key_pools": {"virt_xxx": ["sk-ant-aaa", "sk-ant-bbb"]}}
+      ]}
+    "path_rewrite" replaces "path_prefix" in the forwarded path; omit it to
+    forward the original path unchanged (the default route always does).
+    "key_pools" overrides the global real-key pool from -virtual-keys-file
+    for that virtual key on that route only. Send SIGHUP to reload -config
+    without restarting.
+  * Pass -rewrite-config to rewrite JSON request bodies (force a model,
+    inject/override a system prompt, strip the "user" field, cap
+    max_tokens) and to redact or count tokens in streamed SSE responses:
+      {"by_virtual_key": {"virt_xxx": {"force_model": "gpt-4o-mini"}},
+       "by_path_prefix": {"/v1/chat/completions": {"max_tokens": 1024}}}
+  * Pass -upstream-proxy (or set HTTPS_PROXY/HTTP_PROXY/NO_PROXY) and
+    -ca-bundle to egress through a corporate proxy and trust a private CA
+    when dialing upstream.
+  * /healthz and /readyz report liveness and readiness for Kubernetes, and
+    /metrics exposes Prometheus counters for requests, upstream status
+    codes, rate-limit rejections, and bytes transferred. SIGINT/SIGTERM
+    trigger a graceful shutdown, waiting up to -shutdown-timeout for
+    in-flight requests to finish.
+`, EVN_OPENAI_API_KEY, EVN_OPENAI_API_KEY, HOST_OPENAI_API)
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, additionalHelp1)
@@ -59,32 +152,135 @@ Note:
 
 // config function to get the real OpenAI API key from the environment variables and read virtual API keys from a file
 func config() {
-	// Get the real OpenAI API key from the environment variables
-	realKey = os.Getenv(EVN_OPENAI_API_KEY)
-	if realKey == "" {
-		log.Fatal(errors.New(EVN_OPENAI_API_KEY + " environment variable is not defined. Please set a real OpenAI API key for this"))
-	}
+	// Get the real OpenAI API key from the environment variables; this is used
+	// as the fallback pool for virtual keys that don't define their own.
+	fallbackRealKey = os.Getenv(EVN_OPENAI_API_KEY)
 
 	// Log the loading of virtual API keys from a file
-	log.Printf("*** load virtual api keys from %s", virtualKeyFilePath)
+	slog.Info("loading virtual api keys", "path", virtualKeyFilePath)
 
 	// Read virtual API keys from the specified file
 	content, err := os.ReadFile(virtualKeyFilePath)
 	if err != nil {
-		log.Fatalf("****** Error: %s\nPlease provide virtual API keys in the file: %s, with each key on a separate line.", err, virtualKeyFilePath)
+		slog.Error("failed to read virtual keys file", "path", virtualKeyFilePath, "error", err)
+		os.Exit(1)
 	}
 
-	// Populate the virtualKeys map with the read keys
+	// Populate the virtualKeys and virtualKeyUsage maps with the read keys
 	for _, line := range strings.Split(string(content), "\n") {
 		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine != "" {
-			virtualKeys[trimmedLine] = true
+		if trimmedLine == "" {
+			continue
+		}
+
+		virtualKey, realKeys, limits := parseVirtualKeyLine(trimmedLine)
+		if len(realKeys) == 0 {
+			if fallbackRealKey == "" {
+				slog.Error(EVN_OPENAI_API_KEY+" environment variable is not defined; set a real OpenAI API key, or give virtual key an explicit pool", "virtual_key", virtualKey)
+				os.Exit(1)
+			}
+			realKeys = []string{fallbackRealKey}
+		}
+
+		virtualKeys[virtualKey] = &keyPool{keys: realKeys}
+		virtualKeyUsage[virtualKey] = &usageCounter{limits: limits}
+	}
+
+	// Restore any usage counters persisted from a previous run
+	if err := loadUsageFile(usageFilePath, virtualKeyUsage); err != nil {
+		slog.Error("failed to load usage file", "path", usageFilePath, "error", err)
+		os.Exit(1)
+	}
+
+	// Load the upstream routing table, if one was configured
+	if configFilePath != "" {
+		loaded, err := loadRoutes(configFilePath)
+		if err != nil {
+			slog.Error("failed to load routing config", "path", configFilePath, "error", err)
+			os.Exit(1)
+		}
+		routes = loaded
+		slog.Info("loaded routing config", "path", configFilePath, "routes", len(loaded))
+	}
+
+	// Load the request/response rewrite rules, if any were configured
+	if rewriteConfigFilePath != "" {
+		loaded, err := loadRewrites(rewriteConfigFilePath)
+		if err != nil {
+			slog.Error("failed to load rewrite config", "path", rewriteConfigFilePath, "error", err)
+			os.Exit(1)
 		}
+		rewrites = loaded
+		slog.Info("loaded rewrite config", "path", rewriteConfigFilePath)
 	}
+
+	// Build the transport used for every upstream request
+	transport, err := buildUpstreamTransport()
+	if err != nil {
+		slog.Error("failed to build upstream transport", "error", err)
+		os.Exit(1)
+	}
+	upstreamTransport = transport
+}
+
+// parseVirtualKeyLine splits a single line of the virtual keys file into the
+// virtual key, its pool of real keys, and its optional quota attributes. The
+// expected format is:
+//
+//	virt_xxx = sk-aaa|sk-bbb|sk-ccc ; requests_per_minute=60 daily_limit=1000
+//
+// A bare virtual key with no "=" is also accepted, in which case the real-key
+// pool is left empty so the caller can fall back to the default. The
+// "; attr=val ..." suffix is optional.
+func parseVirtualKeyLine(line string) (string, []string, usageLimits) {
+	virtualKey, rest, hasPool := strings.Cut(line, "=")
+	virtualKey = strings.TrimSpace(virtualKey)
+	if !hasPool {
+		return virtualKey, nil, usageLimits{}
+	}
+
+	pool, attrs, _ := strings.Cut(rest, ";")
+
+	var realKeys []string
+	for _, realKey := range strings.Split(pool, "|") {
+		realKey = strings.TrimSpace(realKey)
+		if realKey != "" {
+			realKeys = append(realKeys, realKey)
+		}
+	}
+
+	var limits usageLimits
+	for _, attr := range strings.Fields(attrs) {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			slog.Error("invalid quota attribute value", "attribute", name, "value", value, "virtual_key", virtualKey)
+			os.Exit(1)
+		}
+		switch strings.TrimSpace(name) {
+		case "requests_per_minute":
+			limits.requestsPerMinute = n
+		case "daily_limit":
+			limits.dailyLimit = n
+		case "monthly_limit":
+			limits.monthlyLimit = n
+		case "total_limit":
+			limits.totalLimit = n
+		default:
+			slog.Error("unknown quota attribute", "attribute", name, "virtual_key", virtualKey)
+			os.Exit(1)
+		}
+	}
+
+	return virtualKey, realKeys, limits
 }
 
 // ReverseProxyHandler handles incoming HTTP requests and forwards them to the OpenAI API with proper authentication
 func ReverseProxyHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := requestIDFromContext(r.Context())
 
 	// Increment the access counter while protecting it with a mutex
 	mu.Lock()
@@ -92,19 +288,20 @@ func ReverseProxyHandler(w http.ResponseWriter, r *http.Request) {
 	count := accessCounter
 	mu.Unlock()
 
-	// Log information about the incoming request
-	// log.Printf("*** request No.%d from %s with auth: %s\n", count, r.RemoteAddr, r.Header.Get("Authorization"))
-	log.Printf("*** request No.%d from %s\n", count, r.RemoteAddr)
-
 	// Check total access limit and return error if exceeded
 	if accessCountLimit != -1 && count > accessCountLimit {
-		log.Printf("****** Warning: Total access limit of %d exceeded", accessCountLimit)
+		slog.Warn("total access limit exceeded", "request_id", requestID, "limit", accessCountLimit)
 		http.Error(w, "Total access count limit exceeded.", http.StatusUnprocessableEntity)
 		return
 	}
 
-	// Set the target OpenAI API and initialize the key variable
-	target := HOST_OPENAI_API
+	// Pick the upstream route for this request's path, and initialize the key variable
+	rt := matchRoute(r.URL.Path)
+	if rt == nil {
+		slog.Warn("no route matched", "request_id", requestID, "path", r.URL.Path)
+		http.Error(w, "No upstream route configured for this path.", http.StatusNotFound)
+		return
+	}
 	key := ""
 
 	// Extract the key from the Authorization header
@@ -113,27 +310,148 @@ func ReverseProxyHandler(w http.ResponseWriter, r *http.Request) {
 		key = strings.TrimPrefix(authHeader, "Bearer ")
 	}
 
-	// Check if the key is a virtual key; if it is, replace it with the real key
-	if _, exists := virtualKeys[key]; exists {
-		key = realKey
+	// Resolve the request/response rewrite rule, if any, before key is
+	// overwritten with the rotated real key below
+	rewriteRule := matchRewriteRule(key, r.URL.Path)
+
+	// Check if the key is a virtual key; if it is, enforce its quota and rate
+	// limit, then rotate to the next real key in its pool (the route's own
+	// pool for this virtual key, if it has one, otherwise the global pool)
+	if pool, exists := resolveKeyPool(rt, key); exists {
+		recordVirtualKeyRequest(key)
+
+		if denial := usageCounterFor(key).checkAndConsume(time.Now()); denial != nil {
+			if denial.quotaExceeded {
+				slog.Warn("virtual key quota exceeded", "request_id", requestID)
+				http.Error(w, "Virtual key quota exceeded.", http.StatusUnprocessableEntity)
+				return
+			}
+			recordRateLimitRejection()
+			slog.Warn("virtual key rate limit exceeded", "request_id", requestID)
+			w.Header().Set("Retry-After", strconv.Itoa(int(denial.retryAfter.Seconds()+1)))
+			http.Error(w, "Virtual key rate limit exceeded.", http.StatusTooManyRequests)
+			return
+		}
+		markUsageDirty()
+
+		var idx int
+		key, idx = pool.next()
+		slog.Info("rotated to upstream key", "request_id", requestID, "key_index", idx)
 	} else {
-		log.Printf("****** Warning: No virtual key found")
+		slog.Warn("no virtual key found", "request_id", requestID)
+	}
+
+	// Rewrite the request body per rewriteRule, if one matched. The body can
+	// only be read once, so it's buffered here and r.Body is replaced with a
+	// fresh reader before the proxy forwards the request.
+	requestBytes := r.ContentLength
+	if rewriteRule != nil && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			slog.Warn("failed to read request body for rewriting", "request_id", requestID, "error", err)
+		} else {
+			rewritten, err := rewriteRequestBody(body, rewriteRule)
+			if err != nil {
+				slog.Warn("failed to rewrite request body", "request_id", requestID, "error", err)
+				rewritten = body
+			}
+			r.Body = io.NopCloser(bytes.NewReader(rewritten))
+			r.ContentLength = int64(len(rewritten))
+			r.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+			requestBytes = int64(len(body))
+		}
+	}
+	if requestBytes < 0 {
+		requestBytes = 0
 	}
 
 	// Set up the reverse proxy director function
 	director := func(req *http.Request) {
-		req.URL.Scheme = "https"
-		req.URL.Host = target
-		req.Host = target
-		req.Header.Set("Authorization", "Bearer "+key)
+		req.URL.Scheme = rt.Scheme
+		req.URL.Host = rt.Host
+		req.Host = rt.Host
+		req.URL.Path = rewritePath(rt, req.URL.Path)
+		req.Header.Del("Authorization")
+		req.Header.Set(rt.AuthHeader, rt.AuthPrefix+key)
+		for header, value := range rt.ExtraHeaders {
+			req.Header.Set(header, value)
+		}
+	}
+
+	// Create a reverse proxy and serve the HTTP request, recording status,
+	// size, and latency for /metrics around the call
+	proxy := &httputil.ReverseProxy{Director: director, Transport: upstreamTransport}
+	if rewriteRule != nil {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if isEventStream(resp) {
+				resp.Body = newSSERewriter(resp.Body, rewriteRule, func(tokens int) {
+					slog.Info("streamed response completed", "request_id", requestID, "completion_tokens", tokens)
+				})
+			}
+			return nil
+		}
 	}
 
-	// Create a reverse proxy and serve the HTTP request
-	proxy := &httputil.ReverseProxy{Director: director}
-	proxy.ServeHTTP(w, r)
+	rec := &responseRecorder{ResponseWriter: w}
+	start := time.Now()
+	proxy.ServeHTTP(rec, r)
 
-	// Log information about the response headers
-	// log.Printf("*** response with header: %s\n", w.Header())
+	recordUpstreamLatency(time.Since(start))
+	recordUpstreamStatus(rec.status)
+	recordBytes(requestBytes, rec.bytes)
+}
+
+// adminUsageEntry is the per-virtual-key summary returned by /admin/usage.
+type adminUsageEntry struct {
+	RequestsPerMinuteLimit int64 `json:"requests_per_minute_limit,omitempty"`
+	DailyLimit             int64 `json:"daily_limit,omitempty"`
+	DailyUsed              int64 `json:"daily_used"`
+	MonthlyLimit           int64 `json:"monthly_limit,omitempty"`
+	MonthlyUsed            int64 `json:"monthly_used"`
+	TotalLimit             int64 `json:"total_limit,omitempty"`
+	TotalUsed              int64 `json:"total_used"`
+}
+
+// AdminUsageHandler reports, per virtual key, the configured limits and the
+// daily, monthly and total counts used so far; it does not compute a
+// remaining figure, which is the limit minus the used count. It requires the "Authorization: Bearer <admin-token>" header to match the
+// -admin-token flag.
+func AdminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		http.Error(w, "Admin endpoint disabled.", http.StatusServiceUnavailable)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	virtualKeyUsageMu.RLock()
+	report := make(map[string]adminUsageEntry, len(virtualKeyUsage))
+	for virtualKey, counter := range virtualKeyUsage {
+		counter.mu.Lock()
+		counter.rollover(time.Now())
+		report[virtualKey] = adminUsageEntry{
+			RequestsPerMinuteLimit: counter.limits.requestsPerMinute,
+			DailyLimit:             counter.limits.dailyLimit,
+			DailyUsed:              counter.dailyCount,
+			MonthlyLimit:           counter.limits.monthlyLimit,
+			MonthlyUsed:            counter.monthlyCount,
+			TotalLimit:             counter.limits.totalLimit,
+			TotalUsed:              counter.totalCount,
+		}
+		counter.mu.Unlock()
+	}
+	virtualKeyUsageMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Warn("failed to encode /admin/usage response", "error", err)
+	}
 }
 
 // main function to start the HTTP server
@@ -143,12 +461,38 @@ func main() {
 
 	// Setup keys configuration
 	config()
+	ready.Store(true)
+
+	// Watch for SIGHUP to hot-reload the routing and rewrite config
+	watchConfigReload()
+
+	// Flush usage counters to -usage-file periodically, off the request
+	// path, and once more on shutdown so the last requests aren't lost
+	usageFlushStop := make(chan struct{})
+	usageFlushDone := make(chan struct{})
+	go func() {
+		startUsageFlusher(usageFilePath, virtualKeyUsage, usageFlushInterval, usageFlushStop)
+		close(usageFlushDone)
+	}()
 
-	// Log the start of the server
-	log.Printf("*** start server: %v\n", port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/usage", withRequestIDMiddleware(AdminUsageHandler))
+	mux.HandleFunc("/metrics", MetricsHandler)
+	mux.HandleFunc("/healthz", HealthzHandler)
+	mux.HandleFunc("/readyz", ReadyzHandler)
+	mux.HandleFunc("/", withRequestIDMiddleware(ReverseProxyHandler))
 
-	// Start the HTTP server with the ReverseProxyHandler as the handler
-	if err := http.ListenAndServe(":"+strconv.Itoa(port), http.HandlerFunc(ReverseProxyHandler)); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+
+	slog.Info("starting server", "port", port)
+	err := runServer(srv, shutdownTimeout)
+
+	close(usageFlushStop)
+	<-usageFlushDone
+
+	if err != nil {
+		slog.Error("server error", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyPoolNextRotatesRoundRobin(t *testing.T) {
+	pool := &keyPool{keys: []string{"a", "b", "c"}}
+
+	var got []string
+	for i := 0; i < 7; i++ {
+		key, idx := pool.next()
+		got = append(got, key)
+		if pool.keys[idx] != key {
+			t.Fatalf("next() returned key %q with mismatched index %d", key, idx)
+		}
+	}
+
+	want := []string{"a", "b", "c", "a", "b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestKeyPoolNextIsSafeForConcurrentUse(t *testing.T) {
+	pool := &keyPool{keys: []string{"a", "b", "c", "d"}}
+
+	counts := make(map[string]int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	const goroutines = 20
+	const perGoroutine = 50
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				key, _ := pool.next()
+				mu.Lock()
+				counts[key]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != goroutines*perGoroutine {
+		t.Fatalf("got %d total calls, want %d", total, goroutines*perGoroutine)
+	}
+	if len(counts) != len(pool.keys) {
+		t.Fatalf("expected all %d keys to be used, got %d", len(pool.keys), len(counts))
+	}
+}
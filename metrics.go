@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsNamespace prefixes every series this proxy exposes at /metrics.
+const metricsNamespace = "openai_proxy"
+
+// labeledCounter is a set of counters distinguished by a single label value,
+// e.g. virtual key or upstream status code.
+type labeledCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{counts: make(map[string]int64)}
+}
+
+func (c *labeledCounter) inc(label string) {
+	c.mu.Lock()
+	c.counts[label]++
+	c.mu.Unlock()
+}
+
+func (c *labeledCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(c.counts))
+	for label, count := range c.counts {
+		snapshot[label] = count
+	}
+	return snapshot
+}
+
+// Metrics tracked across all requests; see the request/response handling in
+// ReverseProxyHandler for where each is recorded.
+var (
+	requestsByVirtualKey = newLabeledCounter()
+	upstreamStatusCounts = newLabeledCounter()
+	rateLimitRejections  int64 // atomic
+	bytesInTotal         int64 // atomic
+	bytesOutTotal        int64 // atomic
+
+	latencyMu    sync.Mutex
+	latencySum   float64
+	latencyCount int64
+)
+
+// recordVirtualKeyRequest increments the request counter for virtualKey.
+func recordVirtualKeyRequest(virtualKey string) {
+	requestsByVirtualKey.inc(virtualKey)
+}
+
+// recordUpstreamStatus increments the counter for an upstream HTTP status
+// code.
+func recordUpstreamStatus(statusCode int) {
+	upstreamStatusCounts.inc(strconv.Itoa(statusCode))
+}
+
+// recordRateLimitRejection counts a 429 returned for exceeding a virtual
+// key's requests_per_minute limit.
+func recordRateLimitRejection() {
+	atomic.AddInt64(&rateLimitRejections, 1)
+}
+
+// recordBytes adds to the running totals of request and response bytes.
+func recordBytes(in, out int64) {
+	atomic.AddInt64(&bytesInTotal, in)
+	atomic.AddInt64(&bytesOutTotal, out)
+}
+
+// recordUpstreamLatency adds one observation to the upstream latency
+// distribution, exposed as a sum/count pair (a Prometheus summary without
+// quantiles).
+func recordUpstreamLatency(d time.Duration) {
+	latencyMu.Lock()
+	latencySum += d.Seconds()
+	latencyCount++
+	latencyMu.Unlock()
+}
+
+// MetricsHandler writes all counters in Prometheus text exposition format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+func writeMetrics(w io.Writer) {
+	requestCounts := requestsByVirtualKey.snapshot()
+	fmt.Fprintf(w, "# HELP %s_requests_total Requests received per virtual key.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_requests_total counter\n", metricsNamespace)
+	for _, label := range sortedKeys(requestCounts) {
+		fmt.Fprintf(w, "%s_requests_total{virtual_key=%q} %d\n", metricsNamespace, label, requestCounts[label])
+	}
+
+	statusCounts := upstreamStatusCounts.snapshot()
+	fmt.Fprintf(w, "# HELP %s_upstream_status_total Responses received per upstream HTTP status code.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_upstream_status_total counter\n", metricsNamespace)
+	for _, label := range sortedKeys(statusCounts) {
+		fmt.Fprintf(w, "%s_upstream_status_total{code=%q} %d\n", metricsNamespace, label, statusCounts[label])
+	}
+
+	fmt.Fprintf(w, "# HELP %s_rate_limit_rejections_total Requests rejected for exceeding a virtual key's rate limit.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_rate_limit_rejections_total counter\n", metricsNamespace)
+	fmt.Fprintf(w, "%s_rate_limit_rejections_total %d\n", metricsNamespace, atomic.LoadInt64(&rateLimitRejections))
+
+	fmt.Fprintf(w, "# HELP %s_bytes_in_total Total bytes received from clients.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_bytes_in_total counter\n", metricsNamespace)
+	fmt.Fprintf(w, "%s_bytes_in_total %d\n", metricsNamespace, atomic.LoadInt64(&bytesInTotal))
+
+	fmt.Fprintf(w, "# HELP %s_bytes_out_total Total bytes sent to clients.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_bytes_out_total counter\n", metricsNamespace)
+	fmt.Fprintf(w, "%s_bytes_out_total %d\n", metricsNamespace, atomic.LoadInt64(&bytesOutTotal))
+
+	latencyMu.Lock()
+	sum, count := latencySum, latencyCount
+	latencyMu.Unlock()
+	fmt.Fprintf(w, "# HELP %s_upstream_latency_seconds Upstream round-trip latency.\n", metricsNamespace)
+	fmt.Fprintf(w, "# TYPE %s_upstream_latency_seconds summary\n", metricsNamespace)
+	fmt.Fprintf(w, "%s_upstream_latency_seconds_sum %f\n", metricsNamespace, sum)
+	fmt.Fprintf(w, "%s_upstream_latency_seconds_count %d\n", metricsNamespace, count)
+}
+
+// sortedKeys returns m's keys sorted, so /metrics output is stable across
+// scrapes.
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
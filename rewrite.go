@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// rewriteRule describes how to rewrite a matching request's JSON body before
+// it reaches the upstream, and how to treat its (possibly streaming)
+// response.
+type rewriteRule struct {
+	ForceModel     string `json:"force_model,omitempty"`      // overwrite "model" unconditionally
+	SystemPrompt   string `json:"system_prompt,omitempty"`    // override (or inject) the first "system" message
+	StripUserField bool   `json:"strip_user_field,omitempty"` // delete the top-level "user" field
+	MaxTokens      int    `json:"max_tokens,omitempty"`       // cap "max_tokens" at this value
+	RedactContent  bool   `json:"redact_content,omitempty"`   // blank out streamed completion content
+}
+
+// rewriteConfig is the on-disk shape of -rewrite-config: rules may be keyed
+// either by the caller's virtual key or by a request path prefix. When both
+// match, the virtual-key rule wins.
+type rewriteConfig struct {
+	ByVirtualKey map[string]rewriteRule `json:"by_virtual_key,omitempty"`
+	ByPathPrefix map[string]rewriteRule `json:"by_path_prefix,omitempty"`
+}
+
+var (
+	rewriteConfigFilePath string // Path to the JSON rewrite rules file; empty disables rewriting
+	rewritesMu            sync.RWMutex
+	rewrites              rewriteConfig
+)
+
+// loadRewrites reads and parses the rewrite rules file.
+func loadRewrites(path string) (rewriteConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return rewriteConfig{}, err
+	}
+
+	var cfg rewriteConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return rewriteConfig{}, err
+	}
+	return cfg, nil
+}
+
+// reloadRewrites re-reads rewriteConfigFilePath and swaps in the new rules.
+func reloadRewrites() {
+	if rewriteConfigFilePath == "" {
+		return
+	}
+
+	loaded, err := loadRewrites(rewriteConfigFilePath)
+	if err != nil {
+		slog.Warn("failed to reload rewrite config", "path", rewriteConfigFilePath, "error", err)
+		return
+	}
+
+	rewritesMu.Lock()
+	rewrites = loaded
+	rewritesMu.Unlock()
+	slog.Info("reloaded rewrite config", "path", rewriteConfigFilePath)
+}
+
+// matchRewriteRule finds the rule that applies to a request from
+// virtualKey on path, or nil if none do.
+func matchRewriteRule(virtualKey, path string) *rewriteRule {
+	rewritesMu.RLock()
+	defer rewritesMu.RUnlock()
+
+	if rule, exists := rewrites.ByVirtualKey[virtualKey]; exists {
+		return &rule
+	}
+
+	var best string
+	var bestRule rewriteRule
+	found := false
+	for prefix, rule := range rewrites.ByPathPrefix {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+			best, bestRule, found = prefix, rule, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &bestRule
+}
+
+// rewriteRequestBody reads body, applies rule's transformations to the
+// top-level JSON object, and returns the re-encoded bytes. Go only lets a
+// request body be read once, so callers must replace r.Body with a reader
+// over the returned bytes before the proxy forwards the request.
+func rewriteRequestBody(body []byte, rule *rewriteRule) ([]byte, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		// Not a JSON object body: leave it untouched.
+		return body, nil
+	}
+
+	if rule.ForceModel != "" {
+		payload["model"] = rule.ForceModel
+	}
+	if rule.StripUserField {
+		delete(payload, "user")
+	}
+	if rule.MaxTokens > 0 {
+		if existing, ok := payload["max_tokens"].(float64); !ok || existing > float64(rule.MaxTokens) {
+			payload["max_tokens"] = rule.MaxTokens
+		}
+	}
+	if rule.SystemPrompt != "" {
+		payload["messages"] = withSystemPrompt(payload["messages"], rule.SystemPrompt)
+	}
+
+	return json.Marshal(payload)
+}
+
+// withSystemPrompt overrides the first "system" message in messages with
+// prompt, or prepends one if there isn't one.
+func withSystemPrompt(messages interface{}, prompt string) interface{} {
+	list, _ := messages.([]interface{})
+
+	for _, m := range list {
+		if message, ok := m.(map[string]interface{}); ok && message["role"] == "system" {
+			message["content"] = prompt
+			return list
+		}
+	}
+
+	systemMessage := map[string]interface{}{"role": "system", "content": prompt}
+	return append([]interface{}{systemMessage}, list...)
+}
+
+// isEventStream reports whether resp looks like an SSE response that should
+// be run through the streaming rewriter rather than passed through as-is.
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// newSSERewriter returns a reader that pumps SSE events from upstream,
+// redacting completion content (if rule.RedactContent) and counting
+// completion tokens as they pass through, without buffering the whole
+// response. onDone is called once, with the total tokens seen, after the
+// stream ends. The caller must Close() the returned reader (it closes
+// upstream in turn).
+func newSSERewriter(upstream io.ReadCloser, rule *rewriteRule, onDone func(tokens int)) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tokens := 0
+		scanner := bufio.NewScanner(upstream)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if data, isData := strings.CutPrefix(line, "data: "); isData && data != "[DONE]" {
+				rewritten, n := rewriteSSEData(data, rule)
+				tokens += n
+				line = "data: " + rewritten
+			}
+			if _, err := pw.Write([]byte(line + "\n")); err != nil {
+				break
+			}
+		}
+		onDone(tokens)
+		pw.CloseWithError(scanner.Err())
+		upstream.Close()
+	}()
+
+	return pr
+}
+
+// rewriteSSEData redacts the delta content of a single chat-completion SSE
+// event (if rule.RedactContent) and returns the (possibly rewritten) event
+// JSON along with its token count, approximated as whitespace-separated
+// words in the streamed content.
+func rewriteSSEData(data string, rule *rewriteRule) (string, int) {
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return data, 0
+	}
+
+	choices, _ := event["choices"].([]interface{})
+	tokens := 0
+	redacted := false
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, _ := delta["content"].(string)
+		tokens += len(strings.Fields(content))
+		if rule.RedactContent && content != "" {
+			delta["content"] = "[REDACTED]"
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return data, tokens
+	}
+	rewritten, err := json.Marshal(event)
+	if err != nil {
+		return data, tokens
+	}
+	return string(rewritten), tokens
+}
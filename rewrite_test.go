@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRequestBodyAppliesAllFields(t *testing.T) {
+	rule := &rewriteRule{
+		ForceModel:     "gpt-4o-mini",
+		StripUserField: true,
+		MaxTokens:      100,
+		SystemPrompt:   "be concise",
+	}
+	body := []byte(`{"model":"gpt-4","user":"alice","max_tokens":500,"messages":[{"role":"user","content":"hi"}]}`)
+
+	rewritten, err := rewriteRequestBody(body, rule)
+	if err != nil {
+		t.Fatalf("rewriteRequestBody returned error: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(rewritten, &payload); err != nil {
+		t.Fatalf("rewritten body is not valid JSON: %v", err)
+	}
+
+	if payload["model"] != "gpt-4o-mini" {
+		t.Errorf("model = %v, want gpt-4o-mini", payload["model"])
+	}
+	if _, exists := payload["user"]; exists {
+		t.Error("expected \"user\" field to be stripped")
+	}
+	if payload["max_tokens"] != float64(100) {
+		t.Errorf("max_tokens = %v, want 100", payload["max_tokens"])
+	}
+
+	messages, _ := payload["messages"].([]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2 (injected system + original)", len(messages))
+	}
+	system, _ := messages[0].(map[string]interface{})
+	if system["role"] != "system" || system["content"] != "be concise" {
+		t.Errorf("messages[0] = %v, want injected system prompt", system)
+	}
+}
+
+func TestRewriteRequestBodyLeavesMaxTokensWhenAlreadyLower(t *testing.T) {
+	rule := &rewriteRule{MaxTokens: 1000}
+	body := []byte(`{"max_tokens":50}`)
+
+	rewritten, err := rewriteRequestBody(body, rule)
+	if err != nil {
+		t.Fatalf("rewriteRequestBody returned error: %v", err)
+	}
+
+	var payload map[string]interface{}
+	json.Unmarshal(rewritten, &payload)
+	if payload["max_tokens"] != float64(50) {
+		t.Errorf("max_tokens = %v, want unchanged 50", payload["max_tokens"])
+	}
+}
+
+func TestRewriteRequestBodyPassesThroughNonJSON(t *testing.T) {
+	rule := &rewriteRule{ForceModel: "gpt-4o-mini"}
+	body := []byte("not json")
+
+	rewritten, err := rewriteRequestBody(body, rule)
+	if err != nil {
+		t.Fatalf("rewriteRequestBody returned error: %v", err)
+	}
+	if string(rewritten) != "not json" {
+		t.Errorf("rewriteRequestBody() = %q, want body untouched", rewritten)
+	}
+}
+
+func TestNewSSERewriterPassesThroughWithoutRedaction(t *testing.T) {
+	stream := "data: " + `{"choices":[{"delta":{"content":"hello world"}}]}` + "\n" +
+		"data: [DONE]\n"
+
+	var gotTokens int
+	reader := newSSERewriter(io.NopCloser(strings.NewReader(stream)), &rewriteRule{}, func(tokens int) {
+		gotTokens = tokens
+	})
+
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed reading rewritten stream: %v", err)
+	}
+
+	if !strings.Contains(string(out), "hello world") {
+		t.Errorf("expected content to pass through unredacted, got %q", out)
+	}
+	if gotTokens != 2 {
+		t.Errorf("onDone tokens = %d, want 2", gotTokens)
+	}
+}
+
+func TestNewSSERewriterRedactsContent(t *testing.T) {
+	stream := "data: " + `{"choices":[{"delta":{"content":"secret stuff"}}]}` + "\n" +
+		"data: [DONE]\n"
+
+	reader := newSSERewriter(io.NopCloser(strings.NewReader(stream)), &rewriteRule{RedactContent: true}, func(int) {})
+
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed reading rewritten stream: %v", err)
+	}
+
+	if strings.Contains(string(out), "secret stuff") {
+		t.Errorf("expected content to be redacted, got %q", out)
+	}
+	if !strings.Contains(string(out), "[REDACTED]") {
+		t.Errorf("expected [REDACTED] marker in output, got %q", out)
+	}
+}
+
+func TestRewriteSSEDataCountsTokens(t *testing.T) {
+	data := `{"choices":[{"delta":{"content":"one two three"}}]}`
+
+	rewritten, tokens := rewriteSSEData(data, &rewriteRule{})
+	if tokens != 3 {
+		t.Errorf("tokens = %d, want 3", tokens)
+	}
+	if rewritten != data {
+		t.Errorf("expected data unchanged when RedactContent is false, got %q", rewritten)
+	}
+}
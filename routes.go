@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// route describes how requests under a given path prefix should be forwarded
+// upstream: which host to dial and how to carry the (rotated) real key,
+// since providers disagree on both.
+type route struct {
+	PathPrefix   string              `json:"path_prefix"`
+	Scheme       string              `json:"scheme"`
+	Host         string              `json:"host"`
+	PathRewrite  *string             `json:"path_rewrite,omitempty"`  // if non-nil, replaces PathPrefix with this (possibly empty) string in the forwarded request path; nil forwards the original path unchanged
+	AuthHeader   string              `json:"auth_header"`             // e.g. "Authorization", "api-key", "x-api-key"
+	AuthPrefix   string              `json:"auth_prefix,omitempty"`   // e.g. "Bearer ", prepended to the real key
+	ExtraHeaders map[string]string   `json:"extra_headers,omitempty"` // e.g. {"anthropic-version": "2023-06-01"}
+	KeyPools     map[string][]string `json:"key_pools,omitempty"`     // per-virtual-key real-key pools scoped to this route, overriding the global pool from the virtual keys file
+
+	resolvedPools map[string]*keyPool // built from KeyPools when the route is loaded
+}
+
+// routeConfig is the on-disk shape of -config.
+type routeConfig struct {
+	Routes []route `json:"routes"`
+}
+
+// defaultRoutes preserves the proxy's original behavior (a single upstream,
+// OpenAI-style bearer auth, path forwarded unchanged) when no -config file
+// is given.
+var defaultRoutes = []route{
+	{PathPrefix: "/", Scheme: "https", Host: HOST_OPENAI_API, AuthHeader: "Authorization", AuthPrefix: "Bearer "},
+}
+
+var (
+	routesMu       sync.RWMutex // Guards routes against concurrent SIGHUP reloads
+	routes         = defaultRoutes
+	configFilePath string // Path to the routing config file; empty keeps defaultRoutes
+)
+
+// loadRoutes reads and parses the routing config file, resolves each route's
+// per-virtual-key key pools, and sorts routes by descending path-prefix
+// length so matchRoute can stop at the first match.
+func loadRoutes(path string) ([]route, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg routeConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Routes) == 0 {
+		return defaultRoutes, nil
+	}
+
+	for i := range cfg.Routes {
+		cfg.Routes[i].resolvedPools = resolveRouteKeyPools(cfg.Routes[i].KeyPools)
+		for virtualKey := range cfg.Routes[i].resolvedPools {
+			ensureUsageCounter(virtualKey)
+		}
+	}
+
+	sort.SliceStable(cfg.Routes, func(i, j int) bool {
+		return len(cfg.Routes[i].PathPrefix) > len(cfg.Routes[j].PathPrefix)
+	})
+	return cfg.Routes, nil
+}
+
+// resolveRouteKeyPools builds a keyPool (with its own rotation counter) for
+// each virtual key that has a route-specific pool configured.
+func resolveRouteKeyPools(keyPools map[string][]string) map[string]*keyPool {
+	if len(keyPools) == 0 {
+		return nil
+	}
+
+	resolved := make(map[string]*keyPool, len(keyPools))
+	for virtualKey, realKeys := range keyPools {
+		if len(realKeys) > 0 {
+			resolved[virtualKey] = &keyPool{keys: realKeys}
+		}
+	}
+	return resolved
+}
+
+// reloadRoutes re-reads configFilePath and swaps in the new routing table. A
+// missing configFilePath is a no-op, since defaultRoutes is already in place.
+func reloadRoutes() {
+	if configFilePath == "" {
+		return
+	}
+
+	loaded, err := loadRoutes(configFilePath)
+	if err != nil {
+		slog.Warn("failed to reload routing config", "path", configFilePath, "error", err)
+		return
+	}
+
+	routesMu.Lock()
+	routes = loaded
+	routesMu.Unlock()
+	slog.Info("reloaded routing config", "path", configFilePath, "routes", len(loaded))
+}
+
+// watchConfigReload re-reads configFilePath and rewriteConfigFilePath
+// whenever the process receives SIGHUP, so operators can update routing and
+// rewrite rules without a restart.
+func watchConfigReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reloadRoutes()
+			reloadRewrites()
+		}
+	}()
+}
+
+// matchRoute returns the most specific route whose PathPrefix matches path,
+// or nil if none match.
+func matchRoute(path string) *route {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	for i := range routes {
+		if strings.HasPrefix(path, routes[i].PathPrefix) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// rewritePath returns the path to forward upstream for rt: path unchanged
+// unless rt.PathRewrite is set, in which case rt.PathPrefix is replaced with
+// it (an empty string strips the prefix entirely).
+func rewritePath(rt *route, path string) string {
+	if rt.PathRewrite == nil {
+		return path
+	}
+	return *rt.PathRewrite + strings.TrimPrefix(path, rt.PathPrefix)
+}
+
+// resolveKeyPool returns the pool to rotate through for virtualKey on rt: a
+// route-specific pool if rt defines one for virtualKey, otherwise the global
+// pool from the virtual keys file.
+func resolveKeyPool(rt *route, virtualKey string) (*keyPool, bool) {
+	if rt != nil {
+		if pool, exists := rt.resolvedPools[virtualKey]; exists {
+			return pool, true
+		}
+	}
+	pool, exists := virtualKeys[virtualKey]
+	return pool, exists
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestRewritePathDefaultRouteLeavesPathUnchanged(t *testing.T) {
+	rt := matchRoute("/v1/chat/completions")
+	if rt == nil {
+		t.Fatal("expected the default route to match /v1/chat/completions")
+	}
+
+	got := rewritePath(rt, "/v1/chat/completions")
+	if got != "/v1/chat/completions" {
+		t.Fatalf("rewritePath() = %q, want unchanged path", got)
+	}
+}
+
+func TestRewritePathStripsPrefixWhenConfigured(t *testing.T) {
+	empty := ""
+	rt := &route{PathPrefix: "/anthropic", PathRewrite: &empty}
+
+	got := rewritePath(rt, "/anthropic/v1/messages")
+	if got != "/v1/messages" {
+		t.Fatalf("rewritePath() = %q, want /v1/messages", got)
+	}
+}
+
+func TestRewritePathReplacesPrefix(t *testing.T) {
+	replacement := "/openai/v1"
+	rt := &route{PathPrefix: "/v1", PathRewrite: &replacement}
+
+	got := rewritePath(rt, "/v1/chat/completions")
+	if got != "/openai/v1/chat/completions" {
+		t.Fatalf("rewritePath() = %q, want /openai/v1/chat/completions", got)
+	}
+}
+
+func TestResolveKeyPoolPrefersRouteSpecificPool(t *testing.T) {
+	global := &keyPool{keys: []string{"global-key"}}
+	routeSpecific := &keyPool{keys: []string{"route-key"}}
+
+	oldVirtualKeys := virtualKeys
+	virtualKeys = map[string]*keyPool{"virt_x": global}
+	defer func() { virtualKeys = oldVirtualKeys }()
+
+	rt := &route{resolvedPools: map[string]*keyPool{"virt_x": routeSpecific}}
+
+	pool, exists := resolveKeyPool(rt, "virt_x")
+	if !exists {
+		t.Fatal("expected a pool to be found")
+	}
+	if pool != routeSpecific {
+		t.Fatal("expected the route-specific pool to win over the global pool")
+	}
+}
+
+func TestResolveKeyPoolFallsBackToGlobalPool(t *testing.T) {
+	global := &keyPool{keys: []string{"global-key"}}
+
+	oldVirtualKeys := virtualKeys
+	virtualKeys = map[string]*keyPool{"virt_x": global}
+	defer func() { virtualKeys = oldVirtualKeys }()
+
+	rt := &route{}
+
+	pool, exists := resolveKeyPool(rt, "virt_x")
+	if !exists || pool != global {
+		t.Fatal("expected resolveKeyPool to fall back to the global pool")
+	}
+}
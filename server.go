@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// contextKey namespaces values this proxy stores in a request's context, to
+// avoid colliding with keys set by other code.
+type contextKey int
+
+const requestIDContextKey contextKey = iota
+
+// requestSeq hands out the IDs used to correlate a request's log lines; it
+// is independent of accessCounter, which enforces -access-count-limit.
+var requestSeq int64
+
+// withRequestIDMiddleware assigns every request a sequential ID, stores it
+// in the request's context so downstream handlers and log lines can
+// correlate on it, and logs when the request starts and finishes.
+func withRequestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := atomic.AddInt64(&requestSeq, 1)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		r = r.WithContext(ctx)
+
+		slog.Info("request received", "request_id", id, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		start := time.Now()
+
+		next(w, r)
+
+		slog.Info("request completed", "request_id", id, "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// requestIDFromContext returns the ID withRequestIDMiddleware assigned to
+// ctx's request, or 0 if none was assigned.
+func requestIDFromContext(ctx context.Context) int64 {
+	id, _ := ctx.Value(requestIDContextKey).(int64)
+	return id
+}
+
+// responseRecorder wraps a http.ResponseWriter to capture the status code
+// and byte count written to it, so callers can record metrics after
+// ServeHTTP returns without the proxy having to expose that itself.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// HealthzHandler is a liveness probe: if the process can handle HTTP at
+// all, it reports healthy.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// ready is flipped to true once config() has finished loading keys, routes,
+// and rewrite rules, so ReadyzHandler doesn't claim readiness too early.
+var ready atomic.Bool
+
+// ReadyzHandler is a readiness probe: it reports healthy once config() has
+// finished loading virtual keys, routes, and rewrite rules.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// runServer starts srv and blocks until it receives SIGINT or SIGTERM, at
+// which point it gives in-flight requests shutdownTimeout to finish before
+// returning.
+func runServer(srv *http.Server, shutdownTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		slog.Info("shutting down", "timeout", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
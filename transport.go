@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Variables controlling how the proxy egresses to upstream providers.
+var (
+	upstreamProxyURL      string        // --upstream-proxy: overrides HTTP_PROXY/HTTPS_PROXY/NO_PROXY when set
+	caBundlePath          string        // --ca-bundle: extra CA certificates to trust, in addition to the system pool
+	dialTimeout           time.Duration // --dial-timeout
+	tlsHandshakeTimeout   time.Duration // --tls-handshake-timeout
+	responseHeaderTimeout time.Duration // --response-header-timeout
+	idleConnTimeout       time.Duration // --idle-conn-timeout
+)
+
+// buildUpstreamTransport constructs the http.Transport used for all upstream
+// requests, honoring the upstream proxy and CA bundle configuration and
+// enabling HTTP/2 and connection pooling.
+func buildUpstreamTransport() (*http.Transport, error) {
+	proxyFunc := http.ProxyFromEnvironment
+	if upstreamProxyURL != "" {
+		parsed, err := url.Parse(upstreamProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -upstream-proxy %q: %w", upstreamProxyURL, err)
+		}
+		proxyFunc = http.ProxyURL(parsed)
+	}
+
+	tlsConfig := &tls.Config{}
+	if caBundlePath != "" {
+		caBundle, err := os.ReadFile(caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ca-bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in -ca-bundle %s", caBundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+	}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// usageLimits holds the optional per-virtual-key quota attributes parsed from
+// the virtual keys file. A zero value for any field means "unlimited".
+type usageLimits struct {
+	requestsPerMinute int64 // requests_per_minute
+	dailyLimit        int64 // daily_limit
+	monthlyLimit      int64 // monthly_limit
+	totalLimit        int64 // total_limit
+}
+
+// usageCounter tracks rate-limit and quota state for a single virtual key.
+// The per-minute limit is enforced with a token bucket; the daily and monthly
+// limits with counters that reset at each calendar day and month, and the
+// total limit with a counter that never resets.
+type usageCounter struct {
+	mu sync.Mutex
+
+	limits usageLimits
+
+	bucketTokens  float64
+	bucketUpdated time.Time
+
+	dailyDate  string // YYYY-MM-DD, reset when this no longer matches today
+	dailyCount int64
+
+	monthlyMonth string // YYYY-MM, reset when this no longer matches this month
+	monthlyCount int64
+
+	totalCount int64
+}
+
+// usageCounterFor returns the usage counter registered for virtualKey, or
+// nil if none exists. Every virtual key from -virtual-keys-file or a route's
+// key_pools has one (see ensureUsageCounter).
+func usageCounterFor(virtualKey string) *usageCounter {
+	virtualKeyUsageMu.RLock()
+	defer virtualKeyUsageMu.RUnlock()
+	return virtualKeyUsage[virtualKey]
+}
+
+// ensureUsageCounter makes sure virtualKey has a usage counter, creating an
+// unlimited one if it doesn't already have one. This keeps a virtual key
+// that's only ever referenced by a route's key_pools (never listed in
+// -virtual-keys-file) first-class: it gets real quota tracking instead of
+// checkAndConsume being skipped or nil-dereferenced.
+func ensureUsageCounter(virtualKey string) {
+	virtualKeyUsageMu.Lock()
+	defer virtualKeyUsageMu.Unlock()
+	if _, exists := virtualKeyUsage[virtualKey]; !exists {
+		virtualKeyUsage[virtualKey] = &usageCounter{}
+	}
+}
+
+// usageDenial describes why a request was rejected by checkAndConsume.
+type usageDenial struct {
+	quotaExceeded bool          // true for daily/monthly/total exhaustion (422), false for rate limiting (429)
+	retryAfter    time.Duration // only meaningful when quotaExceeded is false
+}
+
+// checkAndConsume enforces c's limits for a single request, rolling over the
+// daily/monthly windows as needed. It returns nil if the request is allowed
+// (in which case all counters have already been incremented), or a
+// usageDenial explaining why it was rejected.
+func (c *usageCounter) checkAndConsume(now time.Time) *usageDenial {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollover(now)
+
+	if c.limits.dailyLimit > 0 && c.dailyCount >= c.limits.dailyLimit {
+		return &usageDenial{quotaExceeded: true}
+	}
+	if c.limits.monthlyLimit > 0 && c.monthlyCount >= c.limits.monthlyLimit {
+		return &usageDenial{quotaExceeded: true}
+	}
+	if c.limits.totalLimit > 0 && c.totalCount >= c.limits.totalLimit {
+		return &usageDenial{quotaExceeded: true}
+	}
+
+	if c.limits.requestsPerMinute > 0 {
+		c.refillBucket(now)
+		if c.bucketTokens < 1 {
+			needed := 1 - c.bucketTokens
+			retryAfter := time.Duration(needed * float64(time.Minute) / float64(c.limits.requestsPerMinute))
+			return &usageDenial{retryAfter: retryAfter}
+		}
+		c.bucketTokens--
+	}
+
+	c.dailyCount++
+	c.monthlyCount++
+	c.totalCount++
+	return nil
+}
+
+// refillBucket tops up the token bucket based on the time elapsed since it
+// was last refilled, capped at the per-minute limit.
+func (c *usageCounter) refillBucket(now time.Time) {
+	capacity := float64(c.limits.requestsPerMinute)
+	if c.bucketUpdated.IsZero() {
+		c.bucketTokens = capacity
+		c.bucketUpdated = now
+		return
+	}
+
+	elapsed := now.Sub(c.bucketUpdated).Seconds()
+	c.bucketTokens += elapsed * capacity / 60
+	if c.bucketTokens > capacity {
+		c.bucketTokens = capacity
+	}
+	c.bucketUpdated = now
+}
+
+// rollover resets the daily and monthly counters when the calendar day or
+// month has changed since they were last touched.
+func (c *usageCounter) rollover(now time.Time) {
+	day := now.Format("2006-01-02")
+	if c.dailyDate != day {
+		c.dailyDate = day
+		c.dailyCount = 0
+	}
+
+	month := now.Format("2006-01")
+	if c.monthlyMonth != month {
+		c.monthlyMonth = month
+		c.monthlyCount = 0
+	}
+}
+
+// persistedUsage is the JSON-on-disk representation of a usageCounter,
+// trimmed to the fields that need to survive a restart.
+type persistedUsage struct {
+	DailyDate    string `json:"daily_date"`
+	DailyCount   int64  `json:"daily_count"`
+	MonthlyMonth string `json:"monthly_month"`
+	MonthlyCount int64  `json:"monthly_count"`
+	TotalCount   int64  `json:"total_count"`
+}
+
+// loadUsageFile reads persisted counters from path and applies them to the
+// usageCounters already populated (by config, from the limits in the virtual
+// keys file). A missing file is not an error: it just means this is the
+// first run.
+func loadUsageFile(path string, counters map[string]*usageCounter) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	persisted := make(map[string]persistedUsage)
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		return err
+	}
+
+	for virtualKey, p := range persisted {
+		counter, exists := counters[virtualKey]
+		if !exists {
+			continue
+		}
+		counter.dailyDate = p.DailyDate
+		counter.dailyCount = p.DailyCount
+		counter.monthlyMonth = p.MonthlyMonth
+		counter.monthlyCount = p.MonthlyCount
+		counter.totalCount = p.TotalCount
+	}
+	return nil
+}
+
+// saveUsageFile persists the current counters to path as JSON so they
+// survive a restart.
+func saveUsageFile(path string, counters map[string]*usageCounter) error {
+	virtualKeyUsageMu.RLock()
+	defer virtualKeyUsageMu.RUnlock()
+
+	persisted := make(map[string]persistedUsage, len(counters))
+	for virtualKey, counter := range counters {
+		counter.mu.Lock()
+		persisted[virtualKey] = persistedUsage{
+			DailyDate:    counter.dailyDate,
+			DailyCount:   counter.dailyCount,
+			MonthlyMonth: counter.monthlyMonth,
+			MonthlyCount: counter.monthlyCount,
+			TotalCount:   counter.totalCount,
+		}
+		counter.mu.Unlock()
+	}
+
+	content, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o600)
+}
+
+// usageDirty is set whenever a request changes a usage counter, so
+// startUsageFlusher knows there's something worth writing out. Persistence
+// is debounced onto a ticker, off the request path.
+var usageDirty atomic.Bool
+
+// markUsageDirty flags that virtualKeyUsage has changed since the last
+// flush.
+func markUsageDirty() {
+	usageDirty.Store(true)
+}
+
+// startUsageFlusher persists counters to path every interval, but only if
+// markUsageDirty was called since the last flush, so an idle proxy never
+// touches disk. It blocks until stop is
+// closed, flushing once more before returning so a graceful shutdown doesn't
+// lose the most recent increments.
+func startUsageFlusher(path string, counters map[string]*usageCounter, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if !usageDirty.CompareAndSwap(true, false) {
+			return
+		}
+		if err := saveUsageFile(path, counters); err != nil {
+			slog.Warn("failed to persist usage file", "path", path, "error", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
+	}
+}
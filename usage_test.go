@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefillBucketFirstCallFillsToCapacity(t *testing.T) {
+	c := &usageCounter{limits: usageLimits{requestsPerMinute: 60}}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.refillBucket(now)
+	if c.bucketTokens != 60 {
+		t.Fatalf("bucketTokens = %v, want 60", c.bucketTokens)
+	}
+}
+
+func TestRefillBucketPartialRefill(t *testing.T) {
+	c := &usageCounter{limits: usageLimits{requestsPerMinute: 60}}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.bucketTokens = 0
+	c.bucketUpdated = now
+
+	c.refillBucket(now.Add(30 * time.Second))
+	if c.bucketTokens != 30 {
+		t.Fatalf("bucketTokens = %v, want 30 (half a minute at 60/min)", c.bucketTokens)
+	}
+}
+
+func TestRefillBucketCapsAtCapacity(t *testing.T) {
+	c := &usageCounter{limits: usageLimits{requestsPerMinute: 60}}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.bucketTokens = 0
+	c.bucketUpdated = now
+
+	c.refillBucket(now.Add(10 * time.Minute))
+	if c.bucketTokens != 60 {
+		t.Fatalf("bucketTokens = %v, want capped at 60", c.bucketTokens)
+	}
+}
+
+func TestCheckAndConsumeEnforcesRateLimit(t *testing.T) {
+	c := &usageCounter{limits: usageLimits{requestsPerMinute: 2}}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if denial := c.checkAndConsume(now); denial != nil {
+		t.Fatalf("request 1: unexpected denial %+v", denial)
+	}
+	if denial := c.checkAndConsume(now); denial != nil {
+		t.Fatalf("request 2: unexpected denial %+v", denial)
+	}
+
+	denial := c.checkAndConsume(now)
+	if denial == nil || denial.quotaExceeded {
+		t.Fatalf("request 3: expected a rate-limit denial, got %+v", denial)
+	}
+	if denial.retryAfter <= 0 {
+		t.Fatalf("expected a positive retryAfter, got %v", denial.retryAfter)
+	}
+}
+
+func TestCheckAndConsumeEnforcesDailyLimit(t *testing.T) {
+	c := &usageCounter{limits: usageLimits{dailyLimit: 1}}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if denial := c.checkAndConsume(now); denial != nil {
+		t.Fatalf("request 1: unexpected denial %+v", denial)
+	}
+
+	denial := c.checkAndConsume(now)
+	if denial == nil || !denial.quotaExceeded {
+		t.Fatalf("request 2: expected a quota-exceeded denial, got %+v", denial)
+	}
+}
+
+func TestRolloverResetsDailyCountOnNewDay(t *testing.T) {
+	c := &usageCounter{dailyDate: "2026-01-01", dailyCount: 5, monthlyMonth: "2026-01", monthlyCount: 5}
+
+	c.rollover(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	if c.dailyDate != "2026-01-02" || c.dailyCount != 0 {
+		t.Fatalf("daily counter = %q/%d, want reset to 2026-01-02/0", c.dailyDate, c.dailyCount)
+	}
+	if c.monthlyCount != 5 {
+		t.Fatalf("monthly counter = %d, want untouched within the same month", c.monthlyCount)
+	}
+}
+
+func TestRolloverResetsMonthlyCountOnNewMonth(t *testing.T) {
+	c := &usageCounter{dailyDate: "2026-01-31", dailyCount: 5, monthlyMonth: "2026-01", monthlyCount: 50}
+
+	c.rollover(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+
+	if c.monthlyMonth != "2026-02" || c.monthlyCount != 0 {
+		t.Fatalf("monthly counter = %q/%d, want reset to 2026-02/0", c.monthlyMonth, c.monthlyCount)
+	}
+}
+
+func TestSaveAndLoadUsageFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	original := map[string]*usageCounter{
+		"virt_a": {dailyDate: "2026-01-01", dailyCount: 3, monthlyMonth: "2026-01", monthlyCount: 10, totalCount: 100},
+		"virt_b": {dailyDate: "2026-01-01", dailyCount: 0, monthlyMonth: "2026-01", monthlyCount: 0, totalCount: 0},
+	}
+	if err := saveUsageFile(path, original); err != nil {
+		t.Fatalf("saveUsageFile: %v", err)
+	}
+
+	restored := map[string]*usageCounter{"virt_a": {}, "virt_b": {}}
+	if err := loadUsageFile(path, restored); err != nil {
+		t.Fatalf("loadUsageFile: %v", err)
+	}
+
+	got := restored["virt_a"]
+	if got.dailyDate != "2026-01-01" || got.dailyCount != 3 || got.monthlyMonth != "2026-01" || got.monthlyCount != 10 || got.totalCount != 100 {
+		t.Fatalf("virt_a restored = %+v, want the saved values", got)
+	}
+}
+
+func TestLoadUsageFileMissingIsNotAnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "does-not-exist.json")
+	if err := loadUsageFile(path, map[string]*usageCounter{}); err != nil {
+		t.Fatalf("expected a missing usage file to be ignored, got: %v", err)
+	}
+}
+
+func TestStartUsageFlusherFlushesOnShutdownWhenDirty(t *testing.T) {
+	usageDirty.Store(false)
+	t.Cleanup(func() { usageDirty.Store(false) })
+
+	path := filepath.Join(t.TempDir(), "usage.json")
+	counters := map[string]*usageCounter{"virt_a": {totalCount: 5}}
+
+	markUsageDirty()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		startUsageFlusher(path, counters, time.Hour, stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the usage file to be written on shutdown flush: %v", err)
+	}
+}
+
+func TestStartUsageFlusherSkipsFlushWhenNotDirty(t *testing.T) {
+	usageDirty.Store(false)
+	t.Cleanup(func() { usageDirty.Store(false) })
+
+	path := filepath.Join(t.TempDir(), "usage.json")
+	counters := map[string]*usageCounter{"virt_a": {totalCount: 5}}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		startUsageFlusher(path, counters, time.Hour, stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no usage file to be written when not dirty, stat err = %v", err)
+	}
+}